@@ -0,0 +1,325 @@
+package librp
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// TRPClient 负责把服务端转发过来的请求交给本地插件处理，
+// 而不是像以前那样固定拨号到一个本地 HTTP 地址。
+type TRPClient struct {
+	IRPObject
+	plugin Plugin
+	conn   net.Conn
+
+	writeMu sync.Mutex
+
+	reqMu   sync.Mutex
+	reqBody map[uint32]*io.PipeWriter
+	tunMu   sync.Mutex
+	tunnels map[uint32]*clientStream
+}
+
+// NewRPClient 创建客户端，用给定的 plugin 处理隧道转发来的请求。
+// 旧版本那种"固定转发到一个本地 HTTP 地址"的行为，现在对应 local_forward 插件，
+// 而不是 plugin 传 nil——plugin 为 nil 时 serveRequest 会直接 panic，调用方不应该这么用。
+func NewRPClient(plugin Plugin) *TRPClient {
+	c := new(TRPClient)
+	c.plugin = plugin
+	c.reqBody = make(map[uint32]*io.PipeWriter)
+	c.tunnels = make(map[uint32]*clientStream)
+	return c
+}
+
+// NewRPClientFromConfig 按配置文件里的 `plugin`/`plugin_*` 参数构造插件，
+// 再创建使用该插件处理请求的客户端。
+func NewRPClientFromConfig() (*TRPClient, error) {
+	plugin, err := NewPlugin(conf.Plugin, conf.PluginParams)
+	if err != nil {
+		return nil, err
+	}
+	return NewRPClient(plugin), nil
+}
+
+// Run 连接服务端控制通道、完成握手注册，并持续把收到的请求交给本地插件处理，
+// 直到连接断开（由调用方决定是否重连）。
+func (c *TRPClient) Run(addr string, info *ClientInfo) error {
+	conn, err := DialControl(addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	defer conn.Close()
+
+	if err := wData(conn, encodePacket(PacketVerify, conf.verifyVal[:])); err != nil {
+		return err
+	}
+	infoBytes, err := EncodeClientInfo(info)
+	if err != nil {
+		return err
+	}
+	if err := wData(conn, infoBytes); err != nil {
+		return err
+	}
+	if err := readPacket(conn, func(cmd uint16, data []byte) error {
+		if cmd != PacketVerifyOK {
+			return errors.New("服务端拒绝了本次连接：" + string(data))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	Log.I("已连接到服务端：", addr)
+
+	for {
+		err := readPacket(conn, c.handleFrame)
+		if err != nil {
+			c.closeAllPending()
+			return err
+		}
+	}
+}
+
+// closeAllPending 在控制连接断开时唤醒所有还在等待数据的请求体和隧道，
+// 避免 plugin.Handle() 卡在 req.Body 的读取上，或者 serveTunnel() 永久阻塞在 for range 里。
+func (c *TRPClient) closeAllPending() {
+	c.reqMu.Lock()
+	for id, pw := range c.reqBody {
+		pw.CloseWithError(errors.New("控制连接已断开"))
+		delete(c.reqBody, id)
+	}
+	c.reqMu.Unlock()
+
+	c.tunMu.Lock()
+	for id, s := range c.tunnels {
+		close(s.ch)
+		delete(c.tunnels, id)
+	}
+	c.tunMu.Unlock()
+}
+
+// handleFrame 分发服务端发来的每一帧：新请求开一条协程去跑插件，
+// 请求体分片和结束标记则喂给对应协程，STREAM_* 帧走隧道转发。
+func (c *TRPClient) handleFrame(cmd uint16, data []byte) error {
+	streamID, payload, err := decodeFrame(data)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case PacketReqHeader:
+		req, err := DecodeRequestHeader(payload)
+		if err != nil {
+			return c.writeFrame(PacketRespError, streamID, []byte(err.Error()))
+		}
+		pr, pw := io.Pipe()
+		req.Body = pr
+		c.reqMu.Lock()
+		c.reqBody[streamID] = pw
+		c.reqMu.Unlock()
+		go c.serveRequest(streamID, req)
+
+	case PacketReqBodyChunk:
+		c.reqMu.Lock()
+		pw := c.reqBody[streamID]
+		c.reqMu.Unlock()
+		if pw != nil {
+			pw.Write(payload)
+		}
+
+	case PacketReqEnd:
+		c.reqMu.Lock()
+		pw := c.reqBody[streamID]
+		delete(c.reqBody, streamID)
+		c.reqMu.Unlock()
+		if pw != nil {
+			pw.Close()
+		}
+
+	case PacketStreamOpen:
+		req, err := DecodeRequestHeader(payload)
+		if err != nil {
+			return c.writeFrame(PacketRespError, streamID, []byte(err.Error()))
+		}
+		s := &clientStream{ch: make(chan frame, 16)}
+		c.tunMu.Lock()
+		c.tunnels[streamID] = s
+		c.tunMu.Unlock()
+		go c.serveTunnel(streamID, req, s)
+
+	case PacketStreamData, PacketStreamClose:
+		c.tunMu.Lock()
+		s := c.tunnels[streamID]
+		c.tunMu.Unlock()
+		if s != nil {
+			s.ch <- frame{cmd: cmd, data: payload}
+		}
+	}
+	return nil
+}
+
+// serveRequest 把一个完整的请求交给本地插件处理，并把响应分帧流回服务端。
+// dump 模式下，请求和响应都会记录下来，由 conf.Dump 开关控制（服务端一侧读取的是 conf.Server.Dump）。
+func (c *TRPClient) serveRequest(streamID uint32, r *http.Request) {
+	if conf.Dump {
+		dumpRequest(r)
+	}
+	w := newStreamResponseWriter(c, streamID)
+	c.plugin.Handle(w, r)
+	w.finish()
+	c.writeFrame(PacketRespEnd, streamID, nil)
+}
+
+// hijackPlugin 是可选接口，插件实现它即可为 WebSocket/CONNECT 提供一条裸连接，
+// 否则 CONNECT 请求会退化为直接拨号到 r.Host。
+type hijackPlugin interface {
+	Hijack(r *http.Request) (net.Conn, error)
+}
+
+// serveTunnel 为一次 STREAM_OPEN 建立到真实后端的裸连接，并把双方的数据互相转发。
+func (c *TRPClient) serveTunnel(streamID uint32, r *http.Request, s *clientStream) {
+	defer func() {
+		c.tunMu.Lock()
+		delete(c.tunnels, streamID)
+		c.tunMu.Unlock()
+	}()
+
+	var upstream net.Conn
+	var err error
+	if hp, ok := c.plugin.(hijackPlugin); ok {
+		upstream, err = hp.Hijack(r)
+	} else if r.Method == http.MethodConnect {
+		upstream, err = net.Dial("tcp", r.Host)
+	} else {
+		err = errors.New("当前插件不支持 WebSocket/CONNECT 隧道")
+	}
+	if err != nil {
+		c.writeFrame(PacketRespError, streamID, []byte(err.Error()))
+		return
+	}
+	defer upstream.Close()
+
+	// CONNECT 本身就是在跟后端协商出一条裸 TCP 隧道，不携带请求行/请求头；
+	// 但 WebSocket 这类走普通 HTTP 升级的请求，Hijack 只是拨了个号，真正的升级请求行/请求头
+	// 还得在开始转发裸字节之前，原样补发给后端，否则后端根本不知道这是一次 upgrade。
+	if r.Method != http.MethodConnect {
+		if err := r.Write(upstream); err != nil {
+			c.writeFrame(PacketRespError, streamID, []byte(err.Error()))
+			return
+		}
+	}
+
+	done := make(chan struct{}, 1)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := upstream.Read(buf)
+			if n > 0 {
+				if werr := c.writeFrame(PacketStreamData, streamID, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				c.writeFrame(PacketStreamClose, streamID, nil)
+				return
+			}
+		}
+	}()
+
+	for f := range s.ch {
+		switch f.cmd {
+		case PacketStreamData:
+			if _, err := upstream.Write(f.data); err != nil {
+				return
+			}
+		case PacketStreamClose:
+			return
+		}
+	}
+	// s.ch 被关闭通常意味着控制连接已经断开（见 closeAllPending），这种情况下不再等待
+	// 上面的读取协程退出——它得等 defer 里的 upstream.Close() 才会从 upstream.Read() 解阻塞，
+	// 继续 <-done 只会和那个 defer 死锁。
+}
+
+// writeFrame 把一帧写入控制通道，所有请求/隧道共用同一条连接，因此写入需要互斥。
+func (c *TRPClient) writeFrame(cmd uint16, streamID uint32, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return wData(c.conn, encodeFrame(cmd, streamID, payload))
+}
+
+// streamResponseWriter 把标准的 http.ResponseWriter 调用翻译成 RESP_HEADER/RESP_BODY_CHUNK 帧。
+type streamResponseWriter struct {
+	client      *TRPClient
+	streamID    uint32
+	header      http.Header
+	wroteHeader bool
+	dumpBody    *dumpBodyWriter
+}
+
+func newStreamResponseWriter(c *TRPClient, streamID uint32) *streamResponseWriter {
+	return &streamResponseWriter{client: c, streamID: streamID, header: make(http.Header)}
+}
+
+func (w *streamResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	payload, err := EncodeResponseHeader(statusCode, w.header)
+	if err != nil {
+		Log.E(err)
+		return
+	}
+	w.client.writeFrame(PacketRespHeader, w.streamID, payload)
+	if conf.Dump {
+		dumpResponseHeader(statusCode, w.header)
+		w.dumpBody = newDumpBodyWriter(w.header.Get("Content-Type"))
+	}
+}
+
+func (w *streamResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := w.client.writeFrame(PacketRespBodyChunk, w.streamID, p); err != nil {
+		return 0, err
+	}
+	if w.dumpBody != nil {
+		w.dumpBody.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *streamResponseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.dumpBody != nil {
+		w.dumpBody.Flush()
+	}
+}
+
+// DialControl 建立到服务端控制通道的连接。conf.ControlTLS 开启时使用双向 TLS
+// 并携带客户端证书，否则退化为明文 TCP（此时会打印警告，提醒仅靠共享密钥校验并不安全）。
+// 配置了 conf.PinnedServerCertSHA256 时，用证书指纹锁定代替完整的 CA 链校验，
+// 和服务端的 controlTLSConfig 指纹锁定对称，免去搭建完整 PKI 的要求。
+func DialControl(addr string) (net.Conn, error) {
+	if !conf.ControlTLS {
+		Log.W("控制通道未启用 TLS，仅依赖共享密钥校验，存在被中间人窃听/篡改的风险。")
+		return net.Dial("tcp", addr)
+	}
+	tlsCfg, err := dialControlTLSConfig(conf.TLSCertFile, conf.TLSKeyFile, conf.certPool, conf.PinnedServerCertSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", addr, tlsCfg)
+}
@@ -0,0 +1,32 @@
+package librp
+
+import "encoding/json"
+
+// PacketClientInfo 客户端在 PacketVerify 通过后发送的注册信息，
+// 服务端据此为其分配子域名/自定义域名路由。
+const PacketClientInfo uint16 = 0x20
+
+// ClientInfo 客户端注册元数据。
+type ClientInfo struct {
+	Token         string   `json:"token"`
+	Subdomain     string   `json:"subdomain"`
+	CustomDomains []string `json:"custom_domains"`
+}
+
+// EncodeClientInfo 将客户端注册信息编码为可写入隧道的数据包。
+func EncodeClientInfo(info *ClientInfo) ([]byte, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return encodePacket(PacketClientInfo, data), nil
+}
+
+// DecodeClientInfo 解析客户端发来的注册信息。
+func DecodeClientInfo(data []byte) (*ClientInfo, error) {
+	info := new(ClientInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,88 @@
+package librp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// fingerprintSHA256 计算证书叶子节点的 SHA-256 指纹，格式为冒号分隔的十六进制，
+// 方便在没有完整 PKI 体系时直接比对固定的客户端证书。
+func fingerprintSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// verifyPinnedFingerprint 在开启了证书指纹锁定时，校验对端叶子证书是否在白名单内。
+// pinned 为空表示不启用指纹锁定，只依赖证书链校验。
+func verifyPinnedFingerprint(pinned []string, rawCerts [][]byte) error {
+	if len(pinned) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return errors.New("对端未提供证书，无法校验指纹")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	got := fingerprintSHA256(leaf)
+	for _, want := range pinned {
+		if got == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("对端证书指纹不在信任列表中：%s", got)
+}
+
+// controlTLSConfig 构造控制通道所需的 tls.Config，要求客户端出示证书。
+// 未配置 pinnedFingerprints 时按标准做法校验完整的证书链（ClientCAs）；
+// 配置了的话就改用 RequireAnyClientCert 跳过证书链校验，只凭指纹白名单判断是否放行——
+// 和 dialControlTLSConfig 对称，否则 VerifyPeerCertificate 在证书链校验失败时根本不会被执行
+// （crypto/tls 文档：它在“常规证书校验”之后才调用），指纹锁定也就形同虚设。
+func controlTLSConfig(certFile, keyFile string, clientCAs *x509.CertPool, pinnedFingerprints []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	if len(pinnedFingerprints) > 0 {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinnedFingerprint(pinnedFingerprints, rawCerts)
+		}
+	}
+	return cfg, nil
+}
+
+// dialControlTLSConfig 构造客户端拨号控制通道所需的 tls.Config，与 controlTLSConfig 对称：
+// 给了 pinnedFingerprints 时，用指纹锁定代替标准证书链校验，使客户端也能在没有完整 PKI 的
+// 部署下验证服务端证书，而不是必须信任一整条 CA 链。
+func dialControlTLSConfig(certFile, keyFile string, rootCAs *x509.CertPool, pinnedFingerprints []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}
+	if len(pinnedFingerprints) > 0 {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinnedFingerprint(pinnedFingerprints, rawCerts)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,148 @@
+package librp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// dumpBodyCap 是 dump 模式下单次记录的最大字节数，避免把一个很大的下载/上传整个打进日志。
+const dumpBodyCap = 8 * 1024
+
+// dumpableContentTypes 允许打印body的内容类型（最多打印前 dumpBodyCap 字节），不在此列表中的body一律不打印。
+var dumpableContentTypes = []string{
+	"text/", "application/json", "application/xml",
+	"application/x-www-form-urlencoded", "multipart/form-data",
+}
+
+const (
+	dumpColorReset  = "\x1b[0m"
+	dumpColorYellow = "\x1b[33m"
+	dumpColorCyan   = "\x1b[36m"
+	dumpColorGreen  = "\x1b[32m"
+)
+
+func isDumpableContentType(ct string) bool {
+	mt, _, _ := mime.ParseMediaType(ct)
+	for _, prefix := range dumpableContentTypes {
+		if strings.HasPrefix(mt, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpRequest 打印请求行、请求头，并在是表单提交时解析出字段值。
+// 读取 body 用于展示后会把内容原样拼回去，不影响后续转发。
+func dumpRequest(r *http.Request) {
+	var b strings.Builder
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	b.WriteString(dumpColorYellow + "> " + r.Method + " " + uri + " " + r.Proto + dumpColorReset + "\n")
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			b.WriteString("> " + k + ": " + v + "\n")
+		}
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if r.Body != nil && isDumpableContentType(ct) {
+		raw, err := ioutil.ReadAll(io.LimitReader(r.Body, dumpBodyCap+1))
+		if err == nil {
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(raw), r.Body))
+			truncated := len(raw) > dumpBodyCap
+			if truncated {
+				raw = raw[:dumpBodyCap]
+			}
+			if strings.HasPrefix(ct, "application/x-www-form-urlencoded") || strings.HasPrefix(ct, "multipart/form-data") {
+				dumpFormFields(&b, r, raw, ct)
+			} else {
+				b.WriteString(dumpColorCyan + string(raw) + dumpColorReset + "\n")
+			}
+			if truncated {
+				b.WriteString("> ...(截断)\n")
+			}
+		}
+	}
+	Log.I(b.String())
+}
+
+func dumpFormFields(b *strings.Builder, r *http.Request, raw []byte, ct string) {
+	if strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+		cloned := *r
+		cloned.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		if err := cloned.ParseForm(); err == nil {
+			for k, vs := range cloned.Form {
+				for _, v := range vs {
+					b.WriteString("> form " + k + " = " + v + "\n")
+				}
+			}
+		}
+		return
+	}
+	cloned := *r
+	cloned.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	if err := cloned.ParseMultipartForm(dumpBodyCap); err == nil && cloned.MultipartForm != nil {
+		for k, vs := range cloned.MultipartForm.Value {
+			for _, v := range vs {
+				b.WriteString("> multipart " + k + " = " + v + "\n")
+			}
+		}
+		for k, fhs := range cloned.MultipartForm.File {
+			for _, fh := range fhs {
+				b.WriteString("> multipart file " + k + " = " + fh.Filename + "\n")
+			}
+		}
+	}
+}
+
+// dumpResponseHeader 打印响应状态行和响应头。
+func dumpResponseHeader(statusCode int, header http.Header) {
+	var b strings.Builder
+	b.WriteString(dumpColorGreen + "< status " + http.StatusText(statusCode) + dumpColorReset + "\n")
+	for k, vs := range header {
+		for _, v := range vs {
+			b.WriteString("< " + k + ": " + v + "\n")
+		}
+	}
+	Log.I(b.String())
+}
+
+// dumpBodyWriter 收集响应体的前 dumpBodyCap 字节用于展示，超出部分丢弃不再记录；
+// 它只是旁路记录，响应体本身由调用方另行写出。
+type dumpBodyWriter struct {
+	dumpable bool
+	buf      bytes.Buffer
+	full     bool
+}
+
+func newDumpBodyWriter(contentType string) *dumpBodyWriter {
+	return &dumpBodyWriter{dumpable: isDumpableContentType(contentType)}
+}
+
+func (d *dumpBodyWriter) Write(p []byte) {
+	if !d.dumpable || d.full {
+		return
+	}
+	if d.buf.Len()+len(p) > dumpBodyCap {
+		p = p[:dumpBodyCap-d.buf.Len()]
+		d.full = true
+	}
+	d.buf.Write(p)
+}
+
+func (d *dumpBodyWriter) Flush() {
+	if d.buf.Len() == 0 {
+		return
+	}
+	suffix := ""
+	if d.full {
+		suffix = "\n< ...(截断)"
+	}
+	Log.I(dumpColorCyan + d.buf.String() + dumpColorReset + suffix)
+}
@@ -0,0 +1,162 @@
+package librp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// mitmLeafTTL 控制为某个 SNI 生成的叶子证书在内存缓存里保留多久，
+// 过期后下次握手会重新签发，避免无限增长。
+const mitmLeafTTL = 10 * time.Minute
+
+// MitmCA 是 dump 模式下用于拦截 HTTPS 流量的本地签发 CA。
+// 首次运行时会在 certFile/keyFile 生成一份自签根证书并持久化，后续复用。
+type MitmCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+
+	mu    sync.Mutex
+	cache map[string]*cachedLeaf
+}
+
+type cachedLeaf struct {
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+// LoadOrCreateMitmCA 从磁盘加载本地 CA，如果不存在则生成一份新的并写回磁盘。
+func LoadOrCreateMitmCA(certFile, keyFile string) (*MitmCA, error) {
+	cert, key, err := loadCA(certFile, keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		cert, key, err = generateCA(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MitmCA{cert: cert, key: key, cache: make(map[string]*cachedLeaf)}, nil
+}
+
+func loadCA(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("mitm CA 文件内容不是有效的 PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func generateCA(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "ReverseProxy MITM Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEMFile(certFile, "CERTIFICATE", der); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEMFile(keyFile, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writePEMFile(path, blockType string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+}
+
+// GetCertificate 实现 tls.Config.GetCertificate，按 SNI 现场签发（或复用缓存的）叶子证书。
+func (m *MitmCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if host == "" {
+		return nil, errors.New("客户端未发送 SNI，无法签发证书")
+	}
+
+	m.mu.Lock()
+	if leaf, ok := m.cache[host]; ok && time.Now().Before(leaf.expires) {
+		m.mu.Unlock()
+		return leaf.cert, nil
+	}
+	m.mu.Unlock()
+
+	leaf, err := m.issueLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	now := time.Now()
+	for h, l := range m.cache {
+		if now.After(l.expires) {
+			delete(m.cache, h)
+		}
+	}
+	m.cache[host] = &cachedLeaf{cert: leaf, expires: now.Add(mitmLeafTTL)}
+	m.mu.Unlock()
+	return leaf, nil
+}
+
+func (m *MitmCA) issueLeaf(host string) (*tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.cert, &key.PublicKey, m.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, m.cert.Raw}, PrivateKey: key}, nil
+}
@@ -0,0 +1,33 @@
+package librp
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Plugin 客户端本地处理器。客户端收到服务端转发来的请求后，
+// 不再强制要求本地有一个 HTTP 服务在监听，而是交给 Plugin 决定如何应答，
+// 这样一来诸如静态目录、正向代理、Unix Domain Socket 等场景都无需额外起服务。
+type Plugin interface {
+	// Name 返回插件名，须与配置文件中 `plugin = ` 的取值一致。
+	Name() string
+	// Handle 处理一次隧道请求，实现方式等同于标准库的 http.Handler。
+	Handle(w http.ResponseWriter, r *http.Request)
+}
+
+// pluginFactories 已注册的插件构造函数，以插件名为键。
+var pluginFactories = map[string]func(params map[string]string) (Plugin, error){
+	"static_file":        newStaticFilePlugin,
+	"http_proxy":         newHTTPProxyPlugin,
+	"unix_domain_socket": newUnixSocketPlugin,
+	"local_forward":      newLocalForwardPlugin,
+}
+
+// NewPlugin 根据配置文件里的 `plugin` 与 `plugin_*` 参数构造对应的插件实例。
+func NewPlugin(name string, params map[string]string) (Plugin, error) {
+	factory, ok := pluginFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("未知的插件类型：%s", name)
+	}
+	return factory(params)
+}
@@ -0,0 +1,194 @@
+package librp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+)
+
+// httpProxyPlugin 把隧道变成一个正向 HTTP/HTTPS 代理，支持 CONNECT 方法。
+// dump 模式由全局的 conf.Dump（与服务端的 conf.Server.Dump 对应同一个 --dump 开关）统一控制，
+// 开启后 CONNECT 的 HTTPS 流量会被本地签发的证书中间人解密后记录，再转发给真正的上游。
+type httpProxyPlugin struct {
+	authUser   string
+	authPasswd string
+	dump       bool
+	mitmCA     *MitmCA
+}
+
+func newHTTPProxyPlugin(params map[string]string) (Plugin, error) {
+	p := &httpProxyPlugin{
+		authUser:   params["http_user"],
+		authPasswd: params["http_passwd"],
+	}
+	if conf.Dump {
+		ca, err := LoadOrCreateMitmCA(params["mitm_ca_cert"], params["mitm_ca_key"])
+		if err != nil {
+			return nil, err
+		}
+		p.dump = true
+		p.mitmCA = ca
+	}
+	return p, nil
+}
+
+func (p *httpProxyPlugin) Name() string {
+	return "http_proxy"
+}
+
+// Hijack 实现 hijackPlugin：服务端把一次 CONNECT/WebSocket 升级变成隧道上的
+// 裸字节流转发给客户端时，由这里负责拨号到真正的目标地址。
+// CONNECT 的 r.Host 总是带端口（浏览器/客户端发起 CONNECT 时就是 host:port），
+// 但普通 HTTP 升级请求的 Host 头通常不带端口，这里按 80 补齐，避免 net.Dial 报 missing port。
+// dump 模式下的 CONNECT 返回的是一端内存管道，另一端交给 dumpConnect 解密、记录后再转发给上游。
+func (p *httpProxyPlugin) Hijack(r *http.Request) (net.Conn, error) {
+	if p.dump && r.Method == http.MethodConnect {
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			return nil, err
+		}
+		local, remote := net.Pipe()
+		go func() {
+			defer upstream.Close()
+			p.dumpConnect(remote, upstream, r.Host)
+		}()
+		return local, nil
+	}
+	return net.Dial("tcp", hostWithDefaultPort(r.Host, "80"))
+}
+
+// hostWithDefaultPort 在 host 不带端口时补上 defaultPort。
+func hostWithDefaultPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, defaultPort)
+}
+
+func (p *httpProxyPlugin) Handle(w http.ResponseWriter, r *http.Request) {
+	if p.authUser != "" {
+		user, passwd, ok := r.BasicAuth()
+		if !ok || user != p.authUser || passwd != p.authPasswd {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="restricted"`)
+			http.Error(w, "proxy auth required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+	p.handleForward(w, r)
+}
+
+func (p *httpProxyPlugin) handleConnect(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT 不被当前连接支持", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		Log.E(err)
+		return
+	}
+	defer client.Close()
+
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	if p.dump {
+		p.dumpConnect(client, upstream, r.Host)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dumpConnect 用本地签发的证书在客户端这一侧终结 TLS，
+// 解密后把请求/响应记录下来，再以 TLS 方式转发给真正的上游服务器。
+func (p *httpProxyPlugin) dumpConnect(client net.Conn, upstream net.Conn, host string) {
+	tlsClient := tls.Server(client, &tls.Config{GetCertificate: p.mitmCA.GetCertificate})
+	defer tlsClient.Close()
+	if err := tlsClient.Handshake(); err != nil {
+		Log.E(err)
+		return
+	}
+
+	upstreamHost, _, err := net.SplitHostPort(host)
+	if err != nil {
+		upstreamHost = host
+	}
+	tlsUpstream := tls.Client(upstream, &tls.Config{ServerName: upstreamHost})
+	defer tlsUpstream.Close()
+
+	reader := bufio.NewReader(tlsClient)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+		dumpRequest(req)
+
+		if err := req.Write(tlsUpstream); err != nil {
+			Log.E(err)
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tlsUpstream), req)
+		if err != nil {
+			Log.E(err)
+			return
+		}
+		dumpResponseHeader(resp.StatusCode, resp.Header)
+		dumpBody := newDumpBodyWriter(resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			Log.E(err)
+			return
+		}
+		dumpBody.Write(body)
+		dumpBody.Flush()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err := resp.Write(tlsClient); err != nil {
+			return
+		}
+	}
+}
+
+func (p *httpProxyPlugin) handleForward(w http.ResponseWriter, r *http.Request) {
+	r.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		for _, v2 := range v {
+			w.Header().Add(k, v2)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,43 @@
+package librp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// localForwardPlugin 把请求原样转发给本地某个固定地址的 HTTP 服务，
+// 对应的是这个模块在引入 Plugin 机制之前的行为：客户端只认一个本地地址，不做任何额外处理。
+type localForwardPlugin struct {
+	localAddr string
+	rp        *httputil.ReverseProxy
+}
+
+func newLocalForwardPlugin(params map[string]string) (Plugin, error) {
+	localAddr := params["local_addr"]
+	if localAddr == "" {
+		return nil, errors.New("local_forward 插件缺少 plugin_local_addr 参数")
+	}
+	p := &localForwardPlugin{localAddr: localAddr}
+	p.rp = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = p.localAddr
+		},
+	}
+	return p, nil
+}
+
+func (p *localForwardPlugin) Name() string {
+	return "local_forward"
+}
+
+func (p *localForwardPlugin) Handle(w http.ResponseWriter, r *http.Request) {
+	p.rp.ServeHTTP(w, r)
+}
+
+// Hijack 实现 hijackPlugin：目标地址固定已知，直接拨号即可用于 WebSocket/CONNECT 隧道。
+func (p *localForwardPlugin) Hijack(r *http.Request) (net.Conn, error) {
+	return net.Dial("tcp", p.localAddr)
+}
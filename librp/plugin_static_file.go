@@ -0,0 +1,50 @@
+package librp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// staticFilePlugin 将本地目录以只读方式挂载到隧道上，可选 HTTP Basic 认证。
+type staticFilePlugin struct {
+	localPath  string
+	stripPre   string
+	httpUser   string
+	httpPasswd string
+	handler    http.Handler
+}
+
+func newStaticFilePlugin(params map[string]string) (Plugin, error) {
+	localPath := params["local_path"]
+	if localPath == "" {
+		return nil, errors.New("static_file 插件缺少 plugin_local_path 参数")
+	}
+	p := &staticFilePlugin{
+		localPath:  localPath,
+		stripPre:   params["strip_prefix"],
+		httpUser:   params["http_user"],
+		httpPasswd: params["http_passwd"],
+	}
+	fs := http.FileServer(http.Dir(p.localPath))
+	if p.stripPre != "" {
+		fs = http.StripPrefix(p.stripPre, fs)
+	}
+	p.handler = fs
+	return p, nil
+}
+
+func (p *staticFilePlugin) Name() string {
+	return "static_file"
+}
+
+func (p *staticFilePlugin) Handle(w http.ResponseWriter, r *http.Request) {
+	if p.httpUser != "" {
+		user, passwd, ok := r.BasicAuth()
+		if !ok || user != p.httpUser || passwd != p.httpPasswd {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	p.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,44 @@
+package librp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// unixSocketPlugin 将请求转发给本地的 Unix Domain Socket，
+// 典型用法是挂载 /var/run/docker.sock 以远程访问 Docker API。
+type unixSocketPlugin struct {
+	unixPath string
+	rp       *httputil.ReverseProxy
+}
+
+func newUnixSocketPlugin(params map[string]string) (Plugin, error) {
+	unixPath := params["unix_path"]
+	if unixPath == "" {
+		return nil, errors.New("unix_domain_socket 插件缺少 plugin_unix_path 参数")
+	}
+	p := &unixSocketPlugin{unixPath: unixPath}
+	p.rp = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "unix"
+		},
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", p.unixPath)
+			},
+		},
+	}
+	return p, nil
+}
+
+func (p *unixSocketPlugin) Name() string {
+	return "unix_domain_socket"
+}
+
+func (p *unixSocketPlugin) Handle(w http.ResponseWriter, r *http.Request) {
+	p.rp.ServeHTTP(w, r)
+}
@@ -6,7 +6,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -14,37 +14,106 @@ import (
 	"time"
 )
 
+// rpClient 代表一个已注册的客户端连接，服务端按域名将 HTTP 请求分发给它。
+// 同一客户端的并发请求通过各自的流 ID 区分，不再需要互相等待。
+type rpClient struct {
+	srv           *TRPServer
+	token         string
+	conn          net.Conn
+	subdomain     string
+	customDomains []string
+
+	writeMu      sync.Mutex
+	streamsMu    sync.Mutex
+	streams      map[uint32]*clientStream
+	nextStreamID uint32
+}
+
+// deregister 把自己从服务端的客户端注册表里摘掉，仅当该 token 下挂着的还是自己这条连接时才摘，
+// 避免一个正在走完退出流程的旧连接，错误地删掉已经顶替上来的新连接。
+func (c *rpClient) deregister() {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	if cur, ok := c.srv.clients[c.token]; ok && cur == c {
+		delete(c.srv.clients, c.token)
+	}
+}
+
 type TRPServer struct {
 	IRPObject
 	listener net.Listener
 	httpSvr  *http.Server
-	conn     net.Conn
-	sync.RWMutex
-	running bool
+	clients  map[string]*rpClient // 以客户端 token 为键
+	mu       sync.RWMutex         // 仅保护 clients 这个注册表
+	running  bool
 }
 
 func NewRPServer() *TRPServer {
 	s := new(TRPServer)
+	s.clients = make(map[string]*rpClient)
 	return s
 }
 
+// clientForHost 根据请求的 Host 找到负责处理它的客户端，
+// 依次匹配 custom_domains 精确项，再匹配 "<subdomain>.<VhostDomain>"。
+func (s *TRPServer) clientForHost(host string) *rpClient {
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.clients {
+		for _, d := range c.customDomains {
+			if strings.EqualFold(d, host) {
+				return c
+			}
+		}
+	}
+	if conf.Server.VhostDomain == "" {
+		return nil
+	}
+	suffix := "." + conf.Server.VhostDomain
+	if !strings.HasSuffix(host, suffix) {
+		return nil
+	}
+	sub := strings.TrimSuffix(host, suffix)
+	for _, c := range s.clients {
+		if c.subdomain == sub {
+			return c
+		}
+	}
+	return nil
+}
+
 func (s *TRPServer) Start() error {
 	var err error
 	s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", conf.TCPPort))
-	s.running = true
 	if err != nil {
 		return err
 	}
+	if conf.Server.ControlTLS {
+		tlsCfg, err := controlTLSConfig(conf.Server.TLSCertFile, conf.Server.TLSKeyFile, conf.certPool, conf.Server.PinnedClientCertSHA256)
+		if err != nil {
+			return err
+		}
+		s.listener = tls.NewListener(s.listener, tlsCfg)
+		Log.I("控制通道已启用 mTLS。")
+	} else {
+		Log.W("控制通道未启用 TLS，仅依赖共享密钥校验，存在被中间人窃听/篡改的风险。")
+	}
+	s.running = true
 	go s.httpServer()
 	return s.tcpServer()
 }
 
 func (s *TRPServer) Close() error {
 	s.running = false
-	if s.conn != nil {
-		s.conn.Close()
-		s.conn = nil
+	s.mu.Lock()
+	for token, c := range s.clients {
+		c.conn.Close()
+		delete(s.clients, token)
 	}
+	s.mu.Unlock()
 	if s.httpSvr != nil {
 		ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
 		s.httpSvr.Shutdown(ctx)
@@ -83,44 +152,55 @@ func badRequest(w http.ResponseWriter) {
 	w.Write([]byte(errorHTML))
 }
 
+// THTTPHandler 根据 r.Host 把请求路由给对应的客户端，
+// 每个请求都在独立的流上转发，彼此之间不会相互阻塞。
 type THTTPHandler struct {
 	http.Handler
-	l     sync.RWMutex
-	read  func(w http.ResponseWriter) error
-	write func(r *http.Request) error
+	srv *TRPServer
 }
 
-func newHTTPHandler(l sync.RWMutex, read func(w http.ResponseWriter) error, write func(r *http.Request) error) *THTTPHandler {
+func newHTTPHandler(srv *TRPServer) *THTTPHandler {
 	h := new(THTTPHandler)
-	h.l = l
-	h.read = read
-	h.write = write
+	h.srv = srv
 	return h
 }
 
 func (h *THTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.l.Lock()
-	defer h.l.Unlock()
 	Log.I(r.Method + " " + r.RequestURI)
-	err := h.write(r)
-	if err != nil {
+	c := h.srv.clientForHost(r.Host)
+	if c == nil {
+		Log.W("找不到域名对应的客户端：", r.Host)
 		badRequest(w)
-		Log.E(err)
 		return
 	}
-	err = h.read(w)
-	if err != nil {
+	if isUpgradeRequest(r) {
+		if err := h.srv.tunnel(c, w, r); err != nil {
+			badRequest(w)
+			Log.E(err)
+		}
+		return
+	}
+	if err := h.srv.stream(c, w, r); err != nil {
 		badRequest(w)
 		Log.E(err)
-		return
 	}
 }
 
+// isUpgradeRequest 判断这个请求是否需要一条原始的双向字节流，
+// 而不是一问一答式的请求/响应——WebSocket 升级和 HTTP CONNECT 都属于这一类。
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return true
+	}
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
 func (s *TRPServer) httpServer() {
 
 	s.httpSvr = &http.Server{
 		Addr:    fmt.Sprintf(":%d", conf.Server.HTTPPort),
-		Handler: newHTTPHandler(s.RWMutex, s.read, s.write),
+		Handler: newHTTPHandler(s),
 		TLSConfig: &tls.Config{
 			ClientCAs: conf.certPool,
 			//ClientAuth: tls.RequireAndVerifyClientCert,
@@ -160,56 +240,182 @@ func (s *TRPServer) cliProcess(conn net.Conn) error {
 		conn.Close()
 		return err
 	}
-	// 检测上次已连接的客户端，尝试断开
-	if s.conn != nil {
-		Log.W("服务端已有客户端连接！断开之前的:", IPStr(conn))
-		s.conn.Close()
-		s.conn = nil
+	// 验证通过后，客户端必须紧接着发送一份注册信息，声明自己要接管哪些域名
+	var info *ClientInfo
+	err = readPacket(conn, func(cmd uint16, data []byte) error {
+		if cmd != PacketClientInfo {
+			return errors.New("缺少客户端注册信息。")
+		}
+		info, err = DecodeClientInfo(data)
+		return err
+	})
+	if err != nil || info.Token == "" {
+		Log.W("客户端注册信息无效，关闭此客户端。")
+		conn.Write(EncodeVerifyFailed())
+		conn.Close()
+		return err
+	}
+	s.mu.Lock()
+	// 同一 token 重复连接时，断开旧的连接
+	if old, ok := s.clients[info.Token]; ok {
+		Log.W("客户端重复连接，断开之前的:", IPStr(old.conn))
+		old.conn.Close()
 	}
+	c := &rpClient{srv: s, token: info.Token, conn: conn, subdomain: info.Subdomain, customDomains: info.CustomDomains}
+	c.attachStreams()
+	s.clients[info.Token] = c
+	s.mu.Unlock()
 	if _, err := conn.Write(EncodeVerifyOK()); err != nil {
 		return err
 	}
-	Log.I("连接新的客户端：", IPStr(conn))
-	s.conn = conn
-	keepALive(s.conn)
+	Log.I("连接新的客户端：", IPStr(conn), " token:", info.Token, " subdomain:", info.Subdomain)
+	keepALive(conn)
+	go c.readLoop()
 	return nil
 }
 
-func (s *TRPServer) write(r *http.Request) error {
-	if s.conn == nil {
-		return errors.New("客户端未连接。")
+// tunnel 把一次 HTTP 升级（WebSocket）或 CONNECT 请求变成一条裸字节的双向隧道：
+// 劫持本地这一侧的连接后，在隧道上开一个新流，原始字节直接双向转发，
+// 直到某一侧关闭，中间不再理解其内容。
+func (s *TRPServer) tunnel(c *rpClient, w http.ResponseWriter, r *http.Request) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("当前连接不支持 Hijack，无法升级为双向隧道")
 	}
-	reqBytes, err := EncodeRequest(r)
+	conn, _, err := hijacker.Hijack()
 	if err != nil {
 		return err
 	}
-	return wData(s.conn, reqBytes)
-}
+	defer conn.Close()
+
+	id, st := c.openStream()
+	defer c.closeStream(id)
 
-func (s *TRPServer) read(w http.ResponseWriter) error {
-	return readPacket(s.conn, func(cmd uint16, data []byte) error {
-		switch cmd {
-		case PacketCmd1:
-			resp, err := DecodeResponse(data)
+	headerBytes, err := EncodeRequestHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := c.writeFrame(PacketStreamOpen, id, headerBytes); err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodConnect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{}, 1)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if werr := c.writeFrame(PacketStreamData, id, buf[:n]); werr != nil {
+					return
+				}
+			}
 			if err != nil {
+				c.writeFrame(PacketStreamClose, id, nil)
+				return
+			}
+		}
+	}()
+
+	for f := range st.ch {
+		switch f.cmd {
+		case PacketStreamData:
+			if _, err := conn.Write(f.data); err != nil {
 				return err
 			}
-			bodyBytes, err := ioutil.ReadAll(resp.Body)
+		case PacketStreamClose:
+			return nil
+		case PacketRespError:
+			return errors.New(string(f.data))
+		}
+	}
+	// st.ch 被关闭说明客户端连接已经断开（见 closeAllStreams），而不是浏览器侧主动结束隧道。
+	// 不能继续等 <-done，那只会在浏览器侧空闲连接（比如挂起的 websocket）上永远阻塞、
+	// 泄漏这条协程和被劫持的 fd；defer 里的 conn.Close() 会让读协程的 Read 立刻出错退出。
+	return errors.New("客户端连接已断开")
+}
+
+// stream 以分帧的方式把 r 发给客户端并把客户端的响应流回 w，
+// 请求体和响应体都是边读边转发，不在内存里整体缓冲。
+func (s *TRPServer) stream(c *rpClient, w http.ResponseWriter, r *http.Request) error {
+	id, st := c.openStream()
+	defer c.closeStream(id)
+
+	if conf.Server.Dump {
+		dumpRequest(r)
+	}
+
+	headerBytes, err := EncodeRequestHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := c.writeFrame(PacketReqHeader, id, headerBytes); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Body.Read(buf)
+		if n > 0 {
+			if werr := c.writeFrame(PacketReqBodyChunk, id, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if err := c.writeFrame(PacketReqEnd, id, nil); err != nil {
+		return err
+	}
+
+	headerWritten := false
+	var dumpBody *dumpBodyWriter
+	for f := range st.ch {
+		switch f.cmd {
+		case PacketRespHeader:
+			statusCode, header, err := DecodeResponseHeader(f.data)
 			if err != nil {
 				return err
 			}
-			for k, v := range resp.Header {
+			for k, v := range header {
 				for _, v2 := range v {
-					w.Header().Set(k, v2)
+					w.Header().Add(k, v2)
 				}
 			}
-			w.WriteHeader(resp.StatusCode)
-			w.Write(bodyBytes)
+			w.WriteHeader(statusCode)
+			headerWritten = true
+			if conf.Server.Dump {
+				dumpResponseHeader(statusCode, header)
+				dumpBody = newDumpBodyWriter(header.Get("Content-Type"))
+			}
 
-		case PackageError:
-			return errors.New(string(data))
-		}
+		case PacketRespBodyChunk:
+			if !headerWritten {
+				return errors.New("在响应头之前收到了响应体")
+			}
+			w.Write(f.data)
+			if dumpBody != nil {
+				dumpBody.Write(f.data)
+			}
 
-		return nil
-	})
+		case PacketRespEnd:
+			if dumpBody != nil {
+				dumpBody.Flush()
+			}
+			return nil
+
+		case PacketRespError:
+			return errors.New(string(f.data))
+		}
+	}
+	return errors.New("客户端连接已断开")
 }
@@ -0,0 +1,181 @@
+package librp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// 流式协议的命令字，每一帧都带有一个 uint32 的流 ID，
+// 使得同一条隧道连接上可以并发承载多个请求/响应而互不阻塞。
+const (
+	PacketReqHeader     uint16 = 0x21
+	PacketReqBodyChunk  uint16 = 0x22
+	PacketReqEnd        uint16 = 0x23
+	PacketRespHeader    uint16 = 0x24
+	PacketRespBodyChunk uint16 = 0x25
+	PacketRespEnd       uint16 = 0x26
+	PacketRespError     uint16 = 0x27
+
+	// STREAM_* 用于 WebSocket / CONNECT 这类被劫持的双向连接：
+	// STREAM_OPEN 携带原始请求行/请求头，之后双方就只是互相转发 STREAM_DATA，直到一方发 STREAM_CLOSE。
+	PacketStreamOpen  uint16 = 0x28
+	PacketStreamData  uint16 = 0x29
+	PacketStreamClose uint16 = 0x2A
+)
+
+// frame 是某个流在隧道上传输的一帧数据。
+type frame struct {
+	cmd  uint16
+	data []byte
+}
+
+// encodeFrame 把 streamID 编码进 payload 前 4 字节，再交给底层 encodePacket 打包成可写入隧道的字节流。
+func encodeFrame(cmd uint16, streamID uint32, payload []byte) []byte {
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, streamID)
+	copy(buf[4:], payload)
+	return encodePacket(cmd, buf)
+}
+
+// decodeFrame 从 data 中取出 streamID 和真正的业务负载。
+func decodeFrame(data []byte) (streamID uint32, payload []byte, err error) {
+	if len(data) < 4 {
+		return 0, nil, errors.New("帧数据长度不足，缺少 streamID")
+	}
+	return binary.BigEndian.Uint32(data), data[4:], nil
+}
+
+// clientStream 是单个请求在客户端连接上的一条独立数据流，
+// 收到的 RESP_* 帧按序送入 ch，由发起方按需消费。
+type clientStream struct {
+	ch chan frame
+}
+
+// attachStreams 给 rpClient 初始化流相关的状态，在其被注册时调用一次。
+func (c *rpClient) attachStreams() {
+	c.streams = make(map[uint32]*clientStream)
+}
+
+// openStream 分配一个新的流 ID 并登记接收通道。
+func (c *rpClient) openStream() (uint32, *clientStream) {
+	id := atomic.AddUint32(&c.nextStreamID, 1)
+	s := &clientStream{ch: make(chan frame, 16)}
+	c.streamsMu.Lock()
+	c.streams[id] = s
+	c.streamsMu.Unlock()
+	return id, s
+}
+
+// closeStream 注销一个流，释放其接收通道。
+func (c *rpClient) closeStream(id uint32) {
+	c.streamsMu.Lock()
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+}
+
+// readLoop 是每个客户端连接唯一的读取协程：不断从 conn 读帧，
+// 按 streamID 分发给对应的 clientStream，从而替代旧版本那把全局 RWMutex。
+func (c *rpClient) readLoop() {
+	for {
+		err := readPacket(c.conn, func(cmd uint16, data []byte) error {
+			streamID, payload, err := decodeFrame(data)
+			if err != nil {
+				return err
+			}
+			c.streamsMu.Lock()
+			s, ok := c.streams[streamID]
+			c.streamsMu.Unlock()
+			if !ok {
+				// 流已经被关闭或从未打开（比如客户端超时后补发的尾帧），直接丢弃。
+				return nil
+			}
+			s.ch <- frame{cmd: cmd, data: payload}
+			return nil
+		})
+		if err != nil {
+			Log.W("客户端连接读取结束：", IPStr(c.conn), err)
+			c.closeAllStreams()
+			c.deregister()
+			return
+		}
+	}
+}
+
+// closeAllStreams 在连接断开时唤醒所有还在等待响应的请求，避免它们永久阻塞。
+func (c *rpClient) closeAllStreams() {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	for id, s := range c.streams {
+		close(s.ch)
+		delete(c.streams, id)
+	}
+}
+
+// requestHeaderPayload 是 REQ_HEADER / STREAM_OPEN 帧携带的内容：
+// 只有请求行和请求头，请求体由后续的 REQ_BODY_CHUNK 帧单独传输。
+type requestHeaderPayload struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Host   string      `json:"host"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+}
+
+// EncodeRequestHeader 把请求行/请求头（不含 body）编码为 REQ_HEADER 帧的负载。
+func EncodeRequestHeader(r *http.Request) ([]byte, error) {
+	return json.Marshal(requestHeaderPayload{
+		Method: r.Method,
+		URL:    r.URL.String(),
+		Host:   r.Host,
+		Proto:  r.Proto,
+		Header: r.Header,
+	})
+}
+
+// DecodeRequestHeader 在客户端还原出一个 *http.Request，Body 由调用方自行接上
+// （后续收到的 REQ_BODY_CHUNK/REQ_END 帧）。
+func DecodeRequestHeader(data []byte) (*http.Request, error) {
+	var p requestHeaderPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(p.Method, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Host = p.Host
+	r.Proto = p.Proto
+	r.Header = p.Header
+	return r, nil
+}
+
+// responseHeaderPayload 是 RESP_HEADER 帧携带的内容：状态码和响应头，body 另行分帧。
+type responseHeaderPayload struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
+// EncodeResponseHeader 把状态码/响应头编码为 RESP_HEADER 帧的负载。
+func EncodeResponseHeader(statusCode int, header http.Header) ([]byte, error) {
+	return json.Marshal(responseHeaderPayload{StatusCode: statusCode, Header: header})
+}
+
+// DecodeResponseHeader 解析 RESP_HEADER 帧的负载。
+func DecodeResponseHeader(data []byte) (statusCode int, header http.Header, err error) {
+	var p responseHeaderPayload
+	if err = json.Unmarshal(data, &p); err != nil {
+		return 0, nil, err
+	}
+	return p.StatusCode, p.Header, nil
+}
+
+// writeFrame 把一帧写入隧道，多个流共用同一条连接，因此写入需要互斥。
+func (c *rpClient) writeFrame(cmd uint16, streamID uint32, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return wData(c.conn, encodeFrame(cmd, streamID, payload))
+}